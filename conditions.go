@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConditionsSchema describes how a conditions file's columns map onto a
+// timestamp and an ordered set of wavelength values, resolved once against
+// the controller's reported wavelengths (getWl) so a file's column order
+// doesn't need to match channel order on the light.
+type ConditionsSchema struct {
+	combinedDateTime bool
+	wlCols           []int // column index per wavelength, aligned to Wavelengths
+	Wavelengths      []string
+}
+
+// ConditionsRow is one fully parsed and validated conditions-file entry.
+type ConditionsRow struct {
+	Time   time.Time
+	Values []float64 // aligned to the schema's Wavelengths
+}
+
+// RowError is one bad row found while parsing/validating a conditions file.
+type RowError struct {
+	Line int // 1-based, 0 if not tied to a specific line
+	Err  error
+}
+
+func (e RowError) Error() string {
+	if e.Line == 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+}
+
+// ParseError collects every bad row found in a conditions file, so a long
+// multi-day schedule fails fast before anything runs rather than silently
+// skipping bad rows mid-run.
+type ParseError struct {
+	Errors []RowError
+}
+
+func (e *ParseError) Error() string {
+	lines := make([]string, len(e.Errors))
+	for i, re := range e.Errors {
+		lines[i] = re.Error()
+	}
+	return fmt.Sprintf("%d bad row(s) in conditions file:\n%s", len(e.Errors), strings.Join(lines, "\n"))
+}
+
+// stripComment truncates s at the first '#' that isn't inside a quoted
+// field.
+func stripComment(s string) string {
+	inQuotes := false
+	for i, r := range s {
+		switch r {
+		case '"':
+			inQuotes = !inQuotes
+		case '#':
+			if !inQuotes {
+				return s[:i]
+			}
+		}
+	}
+	return s
+}
+
+// normalizeWlName makes wavelength names from getWl ("450", "6500") and
+// header/line-protocol columns ("450nm", "6500k") comparable.
+func normalizeWlName(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	s = strings.TrimSuffix(s, "nm")
+	s = strings.TrimSuffix(s, "k")
+	return s
+}
+
+// newSchema resolves a conditions-file header row against the controller's
+// reported wavelengths, matching columns by name regardless of order.
+func newSchema(header []string, wavelengths []string) (ConditionsSchema, error) {
+	schema := ConditionsSchema{Wavelengths: wavelengths}
+	schema.combinedDateTime = len(header) > 0 && len(header[0]) >= 8 && strings.EqualFold(header[0][:8], "datetime")
+
+	colByName := make(map[string]int, len(header))
+	for i, h := range header {
+		colByName[normalizeWlName(h)] = i
+	}
+
+	schema.wlCols = make([]int, len(wavelengths))
+	var missing []string
+	for i, wl := range wavelengths {
+		col, ok := colByName[normalizeWlName(wl)]
+		if !ok {
+			missing = append(missing, wl)
+			continue
+		}
+		schema.wlCols[i] = col
+	}
+	if len(missing) > 0 {
+		return schema, fmt.Errorf("header is missing column(s) for wavelength(s): %s", strings.Join(missing, ", "))
+	}
+	return schema, nil
+}
+
+// parseConditionsRow turns one CSV record into a validated ConditionsRow,
+// checking that its timestamp doesn't precede lastTime.
+func parseConditionsRow(record []string, schema ConditionsSchema, lastTime time.Time) (ConditionsRow, error) {
+	var theTime time.Time
+	var err error
+	if schema.combinedDateTime {
+		theTime, err = parseDateTime(record[0])
+	} else if len(record) > 1 {
+		theTime, err = parseDateTime(record[0] + " " + record[1])
+	} else {
+		err = fmt.Errorf("row has no time column")
+	}
+	if err != nil {
+		return ConditionsRow{}, fmt.Errorf("couldn't parse timestamp: %w", err)
+	}
+	if !lastTime.IsZero() && theTime.Before(lastTime) {
+		return ConditionsRow{}, fmt.Errorf("timestamp %s is before previous row's %s", theTime, lastTime)
+	}
+
+	values := make([]float64, len(schema.wlCols))
+	for i, col := range schema.wlCols {
+		if col >= len(record) {
+			return ConditionsRow{}, fmt.Errorf("row is missing column %d for wavelength %s", col, schema.Wavelengths[i])
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(record[col]), 64)
+		if err != nil {
+			return ConditionsRow{}, fmt.Errorf("couldn't parse %q as a value for wavelength %s: %w", record[col], schema.Wavelengths[i], err)
+		}
+		if math.IsNaN(v) || math.IsInf(v, 0) || v < 0 {
+			return ConditionsRow{}, fmt.Errorf("value %v for wavelength %s is out of range", v, schema.Wavelengths[i])
+		}
+		values[i] = v
+	}
+
+	return ConditionsRow{Time: theTime, Values: values}, nil
+}
+
+// parseConditionsCSV parses the header-driven CSV conditions format,
+// validating every row before returning so bad rows are reported together
+// instead of one at a time mid-schedule.
+func parseConditionsCSV(lines []string, wavelengths []string) ([]ConditionsRow, error) {
+	var rows []ConditionsRow
+	var parseErr ParseError
+	var schema ConditionsSchema
+	var lastTime time.Time
+	haveHeader := false
+
+	for i, raw := range lines {
+		line := strings.TrimSpace(stripComment(raw))
+		if line == "" {
+			continue
+		}
+
+		record, err := csv.NewReader(strings.NewReader(line)).Read()
+		if err != nil {
+			parseErr.Errors = append(parseErr.Errors, RowError{Line: i + 1, Err: err})
+			continue
+		}
+
+		if !haveHeader {
+			haveHeader = true
+			schema, err = newSchema(record, wavelengths)
+			if err != nil {
+				// The header itself didn't resolve, so every row's wlCols
+				// would be checked against a broken schema, producing a pile
+				// of misleading per-row errors that mask the real problem.
+				// Report just the header error instead.
+				return nil, &ParseError{Errors: []RowError{{Line: i + 1, Err: err}}}
+			}
+			continue
+		}
+
+		row, err := parseConditionsRow(record, schema, lastTime)
+		if err != nil {
+			parseErr.Errors = append(parseErr.Errors, RowError{Line: i + 1, Err: err})
+			continue
+		}
+		lastTime = row.Time
+		rows = append(rows, row)
+	}
+
+	if len(parseErr.Errors) > 0 {
+		return rows, &parseErr
+	}
+	return rows, nil
+}
+
+// isLineProtocolFormat reports whether a conditions file looks like the
+// `helio-light wavelength=450,power=300 <unix-ts>` line-protocol format
+// rather than header-driven CSV.
+func isLineProtocolFormat(lines []string) bool {
+	for _, raw := range lines {
+		line := strings.TrimSpace(stripComment(raw))
+		if line == "" {
+			continue
+		}
+		return strings.HasPrefix(line, "helio-light ")
+	}
+	return false
+}
+
+// parseConditionsLineProtocol parses the line-protocol conditions format:
+// one `helio-light wavelength=<wl>,power=<v> <unix-ts>` row per wavelength,
+// grouped by timestamp into one ConditionsRow per schedule entry.
+func parseConditionsLineProtocol(lines []string, wavelengths []string) ([]ConditionsRow, error) {
+	type point struct {
+		wavelength string
+		power      float64
+	}
+	byTs := make(map[int64][]point)
+	var tsOrder []int64
+	var parseErr ParseError
+
+	for i, raw := range lines {
+		line := strings.TrimSpace(stripComment(raw))
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "helio-light" {
+			parseErr.Errors = append(parseErr.Errors, RowError{Line: i + 1, Err: fmt.Errorf("malformed line-protocol row %q", line)})
+			continue
+		}
+
+		ts, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			parseErr.Errors = append(parseErr.Errors, RowError{Line: i + 1, Err: fmt.Errorf("couldn't parse timestamp: %w", err)})
+			continue
+		}
+
+		var wl string
+		var power float64
+		havePower := false
+		badField := false
+		for _, kv := range strings.Split(fields[1], ",") {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			switch parts[0] {
+			case "wavelength":
+				wl = parts[1]
+			case "power":
+				power, err = strconv.ParseFloat(parts[1], 64)
+				if err != nil {
+					parseErr.Errors = append(parseErr.Errors, RowError{Line: i + 1, Err: fmt.Errorf("couldn't parse power: %w", err)})
+					badField = true
+					continue
+				}
+				havePower = true
+			}
+		}
+		if badField {
+			continue
+		}
+		if wl == "" || !havePower {
+			parseErr.Errors = append(parseErr.Errors, RowError{Line: i + 1, Err: fmt.Errorf("row is missing wavelength or power field")})
+			continue
+		}
+		if power < 0 || math.IsNaN(power) || math.IsInf(power, 0) {
+			parseErr.Errors = append(parseErr.Errors, RowError{Line: i + 1, Err: fmt.Errorf("power %v is out of range", power)})
+			continue
+		}
+
+		if _, seen := byTs[ts]; !seen {
+			tsOrder = append(tsOrder, ts)
+		}
+		byTs[ts] = append(byTs[ts], point{wavelength: wl, power: power})
+	}
+
+	sort.Slice(tsOrder, func(i, j int) bool { return tsOrder[i] < tsOrder[j] })
+
+	var rows []ConditionsRow
+	var lastTime time.Time
+	for _, ts := range tsOrder {
+		theTime := time.Unix(ts, 0)
+		if !lastTime.IsZero() && theTime.Before(lastTime) {
+			parseErr.Errors = append(parseErr.Errors, RowError{Err: fmt.Errorf("timestamp %s is before previous row's %s", theTime, lastTime)})
+			continue
+		}
+
+		values := make([]float64, len(wavelengths))
+		found := make(map[string]bool, len(wavelengths))
+		for _, p := range byTs[ts] {
+			for i, wl := range wavelengths {
+				if normalizeWlName(wl) == normalizeWlName(p.wavelength) {
+					values[i] = p.power
+					found[wl] = true
+				}
+			}
+		}
+		var missing []string
+		for _, wl := range wavelengths {
+			if !found[wl] {
+				missing = append(missing, wl)
+			}
+		}
+		if len(missing) > 0 {
+			parseErr.Errors = append(parseErr.Errors, RowError{Err: fmt.Errorf("timestamp %s is missing wavelength(s): %s", theTime, strings.Join(missing, ", "))})
+			continue
+		}
+
+		lastTime = theTime
+		rows = append(rows, ConditionsRow{Time: theTime, Values: values})
+	}
+
+	if len(parseErr.Errors) > 0 {
+		return rows, &parseErr
+	}
+	return rows, nil
+}
+
+// parseConditionsFile reads path, auto-detects its format (header-driven
+// CSV, or helio-light line-protocol), and returns every valid row. If any
+// rows failed to parse or validate, it returns a *ParseError listing all
+// of them together so a long multi-day schedule fails fast instead of the
+// previous behaviour of silently `continue`-ing past unparsable lines.
+func parseConditionsFile(path string, wavelengths []string) ([]ConditionsRow, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if isLineProtocolFormat(lines) {
+		return parseConditionsLineProtocol(lines, wavelengths)
+	}
+	return parseConditionsCSV(lines, wavelengths)
+}
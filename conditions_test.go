@@ -0,0 +1,222 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStripComment(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"no comment", "date,time,450,660", "date,time,450,660"},
+		{"trailing comment", "2024-01-01,08:00,100,200 # ramp up", "2024-01-01,08:00,100,200 "},
+		{"hash inside quotes is not a comment", `2024-01-01,08:00,100,"200 # not a comment"`, `2024-01-01,08:00,100,"200 # not a comment"`},
+		{"comment after closed quotes", `"450","660" # header`, `"450","660" `},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := stripComment(c.in); got != c.want {
+				t.Errorf("stripComment(%q) = %q, want %q", c.in, got, c.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeWlName(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"450", "450"},
+		{"450nm", "450"},
+		{"450NM", "450"},
+		{"6500k", "6500"},
+		{"6500K", "6500"},
+		{"  660  ", "660"},
+	}
+	for _, c := range cases {
+		if got := normalizeWlName(c.in); got != c.want {
+			t.Errorf("normalizeWlName(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestNewSchema(t *testing.T) {
+	wavelengths := []string{"450", "660"}
+
+	t.Run("matches regardless of order", func(t *testing.T) {
+		schema, err := newSchema([]string{"date", "time", "660nm", "450nm"}, wavelengths)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if schema.wlCols[0] != 3 || schema.wlCols[1] != 2 {
+			t.Errorf("wlCols = %v, want [3 2]", schema.wlCols)
+		}
+	})
+
+	t.Run("combined datetime column detected", func(t *testing.T) {
+		schema, err := newSchema([]string{"datetime", "450", "660"}, wavelengths)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !schema.combinedDateTime {
+			t.Error("expected combinedDateTime to be true")
+		}
+	})
+
+	t.Run("missing wavelength column", func(t *testing.T) {
+		_, err := newSchema([]string{"date", "time", "450nm"}, wavelengths)
+		if err == nil {
+			t.Fatal("expected an error for a missing wavelength column")
+		}
+		if !strings.Contains(err.Error(), "660") {
+			t.Errorf("error %q should mention the missing wavelength 660", err)
+		}
+	})
+}
+
+func TestParseConditionsCSV(t *testing.T) {
+	wavelengths := []string{"450", "660"}
+
+	t.Run("valid file", func(t *testing.T) {
+		lines := []string{
+			"date,time,450,660",
+			"2024-01-01,08:00,100,200",
+			"2024-01-01,09:00,150,250",
+		}
+		rows, err := parseConditionsCSV(lines, wavelengths)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(rows) != 2 {
+			t.Fatalf("got %d rows, want 2", len(rows))
+		}
+		if rows[0].Values[0] != 100 || rows[0].Values[1] != 200 {
+			t.Errorf("rows[0].Values = %v, want [100 200]", rows[0].Values)
+		}
+	})
+
+	t.Run("quoted fields and trailing comment", func(t *testing.T) {
+		lines := []string{
+			`date,time,"450","660"`,
+			`2024-01-01,08:00,100,"200" # ramp`,
+		}
+		rows, err := parseConditionsCSV(lines, wavelengths)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(rows) != 1 || rows[0].Values[1] != 200 {
+			t.Errorf("rows = %+v, want one row with 660=200", rows)
+		}
+	})
+
+	t.Run("unparsable value is reported, not skipped silently", func(t *testing.T) {
+		lines := []string{
+			"date,time,450,660",
+			"2024-01-01,08:00,notanumber,200",
+		}
+		_, err := parseConditionsCSV(lines, wavelengths)
+		if err == nil {
+			t.Fatal("expected a ParseError for a non-numeric value")
+		}
+		perr, ok := err.(*ParseError)
+		if !ok || len(perr.Errors) != 1 {
+			t.Fatalf("err = %v, want a single-entry *ParseError", err)
+		}
+	})
+
+	t.Run("out of order timestamps are rejected", func(t *testing.T) {
+		lines := []string{
+			"date,time,450,660",
+			"2024-01-01,09:00,100,200",
+			"2024-01-01,08:00,150,250",
+		}
+		_, err := parseConditionsCSV(lines, wavelengths)
+		if err == nil {
+			t.Fatal("expected a ParseError for an out-of-order timestamp")
+		}
+	})
+
+	t.Run("missing wavelength column reports only the header error, not a pile of row errors", func(t *testing.T) {
+		lines := []string{
+			"date,time,450",
+			"2024-01-01,08:00,100",
+			"2024-01-02,08:00,100",
+		}
+		_, err := parseConditionsCSV(lines, wavelengths)
+		if err == nil {
+			t.Fatal("expected a ParseError when the header is missing a wavelength column")
+		}
+		perr, ok := err.(*ParseError)
+		if !ok || len(perr.Errors) != 1 {
+			t.Fatalf("err = %v, want a single-entry *ParseError for the header, not one per data row", err)
+		}
+		if !strings.Contains(perr.Errors[0].Error(), "660") {
+			t.Errorf("error %q should mention the missing wavelength 660", perr.Errors[0])
+		}
+	})
+}
+
+func TestIsLineProtocolFormat(t *testing.T) {
+	if isLineProtocolFormat([]string{"date,time,450,660"}) {
+		t.Error("CSV header should not be detected as line-protocol")
+	}
+	if !isLineProtocolFormat([]string{"# a comment", "helio-light wavelength=450,power=100 1704096000"}) {
+		t.Error("a helio-light row should be detected as line-protocol")
+	}
+}
+
+func TestParseConditionsLineProtocol(t *testing.T) {
+	wavelengths := []string{"450", "660"}
+
+	t.Run("valid rows grouped by timestamp", func(t *testing.T) {
+		lines := []string{
+			"helio-light wavelength=450,power=100 1704096000",
+			"helio-light wavelength=660,power=200 1704096000",
+			"helio-light wavelength=450,power=150 1704099600",
+			"helio-light wavelength=660,power=250 1704099600",
+		}
+		rows, err := parseConditionsLineProtocol(lines, wavelengths)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(rows) != 2 {
+			t.Fatalf("got %d rows, want 2", len(rows))
+		}
+		if rows[0].Values[0] != 100 || rows[0].Values[1] != 200 {
+			t.Errorf("rows[0].Values = %v, want [100 200]", rows[0].Values)
+		}
+	})
+
+	t.Run("malformed row is reported", func(t *testing.T) {
+		lines := []string{"helio-light wavelength=450 power=100 1704096000"}
+		_, err := parseConditionsLineProtocol(lines, wavelengths)
+		if err == nil {
+			t.Fatal("expected a ParseError for a malformed row")
+		}
+	})
+
+	t.Run("timestamp missing wavelength coverage is rejected", func(t *testing.T) {
+		lines := []string{"helio-light wavelength=450,power=100 1704096000"}
+		_, err := parseConditionsLineProtocol(lines, wavelengths)
+		if err == nil {
+			t.Fatal("expected a ParseError when a timestamp is missing a wavelength")
+		}
+	})
+
+	t.Run("rows are grouped and replayed in timestamp order regardless of file order", func(t *testing.T) {
+		lines := []string{
+			"helio-light wavelength=450,power=100 1704099600",
+			"helio-light wavelength=660,power=200 1704099600",
+			"helio-light wavelength=450,power=150 1704096000",
+			"helio-light wavelength=660,power=250 1704096000",
+		}
+		rows, err := parseConditionsLineProtocol(lines, wavelengths)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(rows) != 2 || !rows[0].Time.Before(rows[1].Time) {
+			t.Fatalf("rows = %+v, want the earlier 1704096000 timestamp first", rows)
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ziutek/telnet"
+)
+
+// ConnManager maintains one persistent telnet connection to the light
+// controller, reused across ticks instead of dialing a fresh TCP session
+// on every poll. Each WithConn call sets a read/write deadline before
+// using the connection, so a socket that died silently between ticks
+// (NAT timeout, a reset with no FIN) fails fast instead of hanging
+// execCommand's blocking read forever. A failed call tears the
+// connection down so the next WithConn call redials.
+type ConnManager struct {
+	address string
+	timeout time.Duration
+
+	mu   sync.Mutex
+	conn *telnet.Conn
+}
+
+// NewConnManager builds a ConnManager for address. The connection is
+// dialed lazily on first use, not by NewConnManager itself.
+func NewConnManager(address string, timeout time.Duration) *ConnManager {
+	return &ConnManager{address: address, timeout: timeout}
+}
+
+// WithConn runs fn against the shared connection, dialing first if there's
+// no cached connection. If fn returns an error the connection is assumed
+// dead and is closed so the next WithConn call reconnects.
+func (m *ConnManager) WithConn(fn func(*telnet.Conn) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.conn == nil {
+		if err := m.dialLocked(); err != nil {
+			return err
+		}
+	}
+
+	if err := m.conn.SetDeadline(time.Now().Add(m.timeout)); err != nil {
+		m.conn.Close()
+		m.conn = nil
+		return err
+	}
+
+	if err := fn(m.conn); err != nil {
+		m.conn.Close()
+		m.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (m *ConnManager) dialLocked() error {
+	conn, err := telnet.DialTimeout("tcp", m.address, m.timeout)
+	if err != nil {
+		return err
+	}
+	// Use the stricter "\n>" delimiter the original control path (runStuff)
+	// relied on, not the looser ">" the metrics-only path used: the
+	// connection is now shared between both, and a stray ">" earlier in the
+	// login banner must not be mistaken for the real prompt before a
+	// setWlsRelPower write.
+	if err := conn.SkipUntil("\n>"); err != nil {
+		conn.Close()
+		return err
+	}
+	m.conn = conn
+	return nil
+}
+
+// Close closes the underlying connection, if any is currently cached.
+func (m *ConnManager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn == nil {
+		return nil
+	}
+	err := m.conn.Close()
+	m.conn = nil
+	return err
+}
@@ -1,45 +1,52 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"github.com/bcampbell/fuzzytime"
-	"github.com/mdaffin/go-telegraf"
 	"github.com/ziutek/telnet"
 	"log"
 	"math"
 	"os"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
 var (
-	errLog     *log.Logger
-	ctx        fuzzytime.Context
-	zoneName   string
-	zoneOffset int
+	errLog      *Logger
+	ctx         fuzzytime.Context
+	zoneName    string
+	zoneOffset  int
+	metricsSink MetricsSink
+	connManager *ConnManager
 )
 
 var (
-	noMetrics, dummy                           bool
-	address                                    string
-	multiplier                                 float64
-	conditionsPath, hostTag, groupTag, userTag string
-	interval                                   time.Duration
+	noMetrics, dummy                                bool
+	address                                         string
+	multiplier                                      float64
+	conditionsPath, hostTag, groupTag, userTag      string
+	interval                                        time.Duration
+	alias, logDestination, logLevel                 string
+	output                                          string
+	promListen                                      string
+	influxURL, influxOrg, influxBucket, influxToken string
+	influxBatchSize                                 int
+	shutdownPower                                   float64
 )
 
 const (
-	matchFloatExp   = `[-+]?\d*\.\d+|\d+`
 	matchIntsExp    = `\b(\d+)\b`
 	matchOKExp      = `OK`
 	matchStringsExp = `\b(\w+)\b`
 )
 
 // TsRegex is a regexp to find a timestamp within a filename
-var /* const */ matchFloat = regexp.MustCompile(matchFloatExp)
 var /* const */ matchInts = regexp.MustCompile(matchIntsExp)
 var /* const */ matchOK = regexp.MustCompile(matchOKExp)
 var /* const */ matchStrings = regexp.MustCompile(matchStringsExp)
@@ -60,6 +67,13 @@ flags:
 	-dummy: don't control the chamber, only collect metrics (this is implied by not specifying a conditions file
 	-conditions: conditions to use to run the chamber
 	-interval: what interval to run conditions/record metrics at, set to 0s to read 1 metric and exit. (default=10m)
+	-alias: alias for this instance, added to log lines and emitted metrics (env ALIAS)
+	-log-destination: where to send logs: stderr, syslog, or a file path (env LOG_DESTINATION, default=stderr)
+	-log-level: minimum log level to emit: debug, info, warn, error (env LOG_LEVEL, default=info)
+	-output: where to publish metrics: telegraf or influx (env OUTPUT, default=telegraf)
+	-influx-url, -influx-org, -influx-bucket, -influx-token, -influx-batch-size: InfluxDB v2 settings, used when -output=influx
+	-prom-listen: address to serve a prometheus /metrics endpoint on, e.g. :9090 (env PROM_LISTEN, disabled if empty)
+	-shutdown-power: rel power level to set all channels to before exiting, on SIGINT/SIGTERM or when the conditions file ends (env SHUTDOWN_POWER, default=0)
 
 examples:
 	collect data on 192.168.1.3  and output the errors to GC03-error.log and record the output to GC03.log
@@ -69,11 +83,14 @@ examples:
 	%s -conditions GC03-conditions.csv -dummy 192.168.1.3 2>> GC03-error.log 1>> GC03.log
 
 quirks:
-	the first 3 or 4 columns are used for running the chamber:
-		date,time,temperature,humidity OR datetime,temperature,humidity
-		the second case only occurs if the first 8 characters of the file (0th header) is "datetime"
-
-	for the moment, the first line of the csv is technically (this is for your headers)
+	the conditions file is either:
+		a header-driven CSV: date,time,<wavelength columns...> OR datetime,<wavelength columns...>
+		(the datetime form only occurs if the first 8 characters of the file's header (0th column) is "datetime")
+		wavelength columns are matched to the light by name against getWl, in whatever order the header has them
+		quoted fields, inline "#" comments and empty lines are all allowed
+	or a line-protocol file of "helio-light wavelength=<wl>,power=<v> <unix-ts>" rows, one per wavelength per timestamp
+
+	every row is parsed and validated up front; a file with any bad rows is rejected before anything runs.
 	if both -dummy and -no-metrics are specified, this program will exit.
 
 `
@@ -84,7 +101,7 @@ func parseDateTime(tString string) (time.Time, error) {
 
 	datetimeValue, _, err := ctx.Extract(tString)
 	if err != nil {
-		errLog.Printf("couldn't extract datetime: %s", err)
+		errLog.Warnf("couldn't extract datetime: %s", err)
 	}
 
 	datetimeValue.Time.SetHour(datetimeValue.Time.Hour())
@@ -146,62 +163,63 @@ func chompAllStrings(conn *telnet.Conn, command string) (values []string, err er
 	return
 }
 
-func runConditions() {
-	errLog.Printf("running conditions file: %s\n", conditionsPath)
-	file, err := os.Open(conditionsPath)
+func runConditions(runCtx context.Context) {
+	errLog.Infof("running conditions file: %s\n", conditionsPath)
+
+	var wavelengths []string
+	err := connManager.WithConn(func(conn *telnet.Conn) (err error) {
+		wavelengths, err = getWl(conn)
+		return
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	rows, err := parseConditionsFile(conditionsPath, wavelengths)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer file.Close()
-	scanner := bufio.NewScanner(file)
+	errLog.Infof("validated %d row(s) in conditions file\n", len(rows))
+	totalRows := len(rows)
+
 	idx := 0
 	var lastTime time.Time
-	var lastLineSplit []string
+	var lastValues []float64
 	firstRun := true
-	for scanner.Scan() {
-		line := scanner.Text()
-		if idx == 0 {
+	for _, row := range rows {
+		if row.Time.Before(time.Now()) {
+			lastTime = row.Time
+			lastValues = row.Values
 			idx++
-			continue
-		}
-
-		lineSplit := strings.Split(line, ",")
-		timeStr := lineSplit[0]
-		theTime, err := parseDateTime(timeStr)
-		if err != nil {
-			errLog.Println(err)
-			continue
-		}
-
-		// if we are before the time skip until we are after it
-		// the -10s means that we shouldnt run again.
-		if theTime.Before(time.Now()) {
-			lastLineSplit = lineSplit
-			lastTime = theTime
+			recordConditionsProgress(idx, totalRows)
 			continue
 		}
 
 		if firstRun {
 			firstRun = false
-			errLog.Println("running firstrun line")
+			errLog.Info("running firstrun line")
 			for i := 0; i < 10; i++ {
-				if runStuff(lastTime, lastLineSplit) {
+				if runStuff(lastTime, lastValues, wavelengths) {
 					break
 				}
 			}
 		}
 
-		errLog.Printf("sleeping for %ds\n", int(time.Until(theTime).Seconds()))
-		time.Sleep(time.Until(theTime))
+		errLog.Debugf("sleeping for %ds\n", int(time.Until(row.Time).Seconds()))
+		select {
+		case <-time.After(time.Until(row.Time)):
+		case <-runCtx.Done():
+			errLog.Info("shutting down, stopping conditions file early")
+			return
+		}
 
-		// RUN STUFF HERE
 		for i := 0; i < 10; i++ {
-			if runStuff(theTime, lineSplit) {
+			if runStuff(row.Time, row.Values, wavelengths) {
 				break
 			}
 		}
-		// end RUN STUFF
 		idx++
+		recordConditionsProgress(idx, totalRows)
 	}
 }
 
@@ -233,8 +251,8 @@ func intToString(a []int) []string {
 
 func setMany(conn *telnet.Conn, values []float64) (err error) {
 	intVals := make([]int, len(values))
-	for i,x := range values{
-		intVals[i] = minMax(int(x*multiplier))
+	for i, x := range values {
+		intVals[i] = minMax(int(x * multiplier))
 	}
 	command := "setWlsRelPower "
 	command += strings.Join(intToString(intVals), " ")
@@ -245,7 +263,7 @@ func setMany(conn *telnet.Conn, values []float64) (err error) {
 
 func getPower(conn *telnet.Conn) (values []float64, err error) {
 	intValues, err := chompAllInts(conn, "getAllRelPower")
-	for _, v := range intValues{
+	for _, v := range intValues {
 		values = append(values, float64(v)/multiplier)
 	}
 	return
@@ -256,59 +274,25 @@ func getWl(conn *telnet.Conn) (values []string, err error) {
 	return
 }
 
-// runStuff, should send values and write metrics.
+// runStuff sends an already-parsed, already-validated row's light values
+// (aligned to wavelengths) and writes metrics.
 // returns true if program should continue, false if program should retry
-func runStuff(theTime time.Time, lineSplit []string) bool {
-	stringVals := lineSplit[4:]
-	lightValues := make([]float64, len(stringVals))
-
-	for i, v := range stringVals {
-		found := matchFloat.FindString(v)
-		if len(found) < 0 {
-			errLog.Printf("couldnt parse %s as float.\n", v)
-			continue
-		}
-		fl, err := strconv.ParseFloat(found, 64)
-		if err != nil {
-			errLog.Println(err)
-			continue
-		}
-		lightValues[i] = fl
-	}
-	conn, err := telnet.DialTimeout("tcp", address, time.Second*30)
-	if err != nil {
-		errLog.Println(err)
-		return false
-	}
-	defer conn.Close()
-	err = conn.SkipUntil("\n>")
-	if err != nil {
-		errLog.Println(err)
-		return false
-	}
-
-
-	wavelengths, err := getWl(conn)
+func runStuff(theTime time.Time, lightValues []float64, wavelengths []string) bool {
+	err := connManager.WithConn(func(conn *telnet.Conn) error {
+		return setMany(conn, lightValues)
+	})
 	if err != nil {
-		errLog.Println(err)
+		errLog.Error(err)
+		recordPoll(nil, nil, err)
 		return false
 	}
-	minLength := min(len(wavelengths),len(lightValues))
-	if len(lightValues) != minLength{
-		errLog.Println("Different number of light values than wavelengths")
-	}
 
-	err = setMany(conn, lightValues[:minLength])
-	if err != nil{
-		errLog.Println(err)
-		return false
-	}
-
-	errLog.Println("ran ", theTime.Format("2006-01-02T15:04:05"), lightValues)
+	recordPoll(wavelengths, lightValues, nil)
+	errLog.Info("ran ", theTime.Format("2006-01-02T15:04:05"), lightValues)
 
 	for x := 0; x < 5; x++ {
 		if err := writeMetrics(wavelengths, lightValues); err != nil {
-			errLog.Println(err)
+			errLog.Error(err)
 			time.Sleep(200 * time.Millisecond)
 			continue
 		}
@@ -317,53 +301,18 @@ func runStuff(theTime time.Time, lineSplit []string) bool {
 	return true
 }
 
+// writeMetrics publishes a reading via the configured MetricsSink, unless
+// -no-metrics suppressed publishing entirely.
 func writeMetrics(wavelengths []string, lightValues []float64) error {
-	if !noMetrics {
-		telegrafHost := "telegraf:8092"
-		if os.Getenv("TELEGRAF_HOST") != "" {
-			telegrafHost = os.Getenv("TELEGRAF_HOST")
-		}
-
-		telegrafClient, err := telegraf.NewUDP(telegrafHost)
-		if err != nil {
-			return err
-		}
-		defer telegrafClient.Close()
-
-		m := telegraf.NewMeasurement("helio-light")
-		if len(wavelengths) != len(lightValues) {
-			return fmt.Errorf("wavelengths and light values differ")
-		}
-
-		for i, v := range lightValues {
-			wl,err := strconv.ParseInt(wavelengths[i], 10, 64)
-			if err != nil{
-				errLog.Println(err)
-				continue
-			}
-			if wl == 6500 {
-				m.AddFloat64(fmt.Sprintf("%dk", wl), v)
-				continue
-			}
-			m.AddFloat64(fmt.Sprintf("%dnm", wl), v)
-		}
-		if hostTag != "" {
-			m.AddTag("host", hostTag)
-		}
-		if groupTag != "" {
-			m.AddTag("group", groupTag)
-		}
-		if userTag != "" {
-			m.AddTag("user", userTag)
-		}
-
-		telegrafClient.Write(m)
+	if noMetrics {
+		return nil
 	}
-	return nil
+	return metricsSink.Write(wavelengths, lightValues)
 }
 
 func init() {
 	var err error
+	var envParseErrs []error
 	hostname := os.Getenv("NAME")
 
 	if address = os.Getenv("ADDRESS"); address == "" {
@@ -373,7 +322,7 @@ func init() {
 		}
 	}
 
-	errLog = log.New(os.Stderr, "[heliospectra] ", log.Ldate|log.Ltime|log.Lshortfile)
+	errLog = newLogger(os.Stderr, "", LevelInfo)
 	// get the local zone and offset
 	zoneName, zoneOffset = time.Now().Zone()
 
@@ -415,6 +364,59 @@ func init() {
 		userTag = tempV
 	}
 
+	flag.StringVar(&alias, "alias", "", "alias for this instance, added to log lines and emitted metrics")
+	if tempV := os.Getenv("ALIAS"); tempV != "" {
+		alias = tempV
+	}
+
+	flag.StringVar(&logDestination, "log-destination", "stderr", "where to send logs: stderr, syslog, or a file path")
+	if tempV := os.Getenv("LOG_DESTINATION"); tempV != "" {
+		logDestination = tempV
+	}
+
+	flag.StringVar(&logLevel, "log-level", "info", "minimum log level to emit: debug, info, warn, error")
+	if tempV := os.Getenv("LOG_LEVEL"); tempV != "" {
+		logLevel = tempV
+	}
+
+	flag.StringVar(&output, "output", "telegraf", "where to publish metrics: telegraf or influx")
+	if tempV := os.Getenv("OUTPUT"); tempV != "" {
+		output = tempV
+	}
+
+	flag.StringVar(&promListen, "prom-listen", "", "address to serve a prometheus /metrics endpoint on, e.g. :9090 (disabled if empty)")
+	if tempV := os.Getenv("PROM_LISTEN"); tempV != "" {
+		promListen = tempV
+	}
+
+	flag.StringVar(&influxURL, "influx-url", "http://influxdb:8086", "InfluxDB v2 base URL, used when -output=influx")
+	if tempV := os.Getenv("INFLUX_URL"); tempV != "" {
+		influxURL = tempV
+	}
+
+	flag.StringVar(&influxOrg, "influx-org", "", "InfluxDB v2 org, used when -output=influx")
+	if tempV := os.Getenv("INFLUX_ORG"); tempV != "" {
+		influxOrg = tempV
+	}
+
+	flag.StringVar(&influxBucket, "influx-bucket", "", "InfluxDB v2 bucket, used when -output=influx")
+	if tempV := os.Getenv("INFLUX_BUCKET"); tempV != "" {
+		influxBucket = tempV
+	}
+
+	flag.StringVar(&influxToken, "influx-token", "", "InfluxDB v2 auth token, used when -output=influx")
+	if tempV := os.Getenv("INFLUX_TOKEN"); tempV != "" {
+		influxToken = tempV
+	}
+
+	flag.IntVar(&influxBatchSize, "influx-batch-size", 1, "number of points to batch before writing to InfluxDB")
+	if tempV := os.Getenv("INFLUX_BATCH_SIZE"); tempV != "" {
+		influxBatchSize, err = strconv.Atoi(tempV)
+		if err != nil {
+			envParseErrs = append(envParseErrs, fmt.Errorf("couldn't parse influx-batch-size from environment: %w", err))
+		}
+	}
+
 	flag.StringVar(&conditionsPath, "conditions", "", "conditions file to")
 	if tempV := os.Getenv("CONDITIONS_FILE"); tempV != "" {
 		conditionsPath = tempV
@@ -423,59 +425,135 @@ func init() {
 	if tempV := os.Getenv("INTERVAL"); tempV != "" {
 		interval, err = time.ParseDuration(tempV)
 		if err != nil {
-			errLog.Println("Couldnt parse interval from environment")
-			errLog.Println(err)
+			envParseErrs = append(envParseErrs, fmt.Errorf("couldn't parse interval from environment: %w", err))
 		}
 	}
 	flag.Float64Var(&multiplier, "multiplier", 10.0, "multiplier for the light")
 	if tempV := os.Getenv("MULTIPLIER"); tempV != "" {
 		multiplier, err = strconv.ParseFloat(tempV, 64)
 		if err != nil {
-			errLog.Println("Couldnt parse multiplier from environment")
-			errLog.Println(err)
+			envParseErrs = append(envParseErrs, fmt.Errorf("couldn't parse multiplier from environment: %w", err))
 		}
 	}
-	flag.Parse()
+	flag.Float64Var(&shutdownPower, "shutdown-power", 0, "rel power level to set all channels to on SIGINT/SIGTERM before exiting")
+	if tempV := os.Getenv("SHUTDOWN_POWER"); tempV != "" {
+		shutdownPower, err = strconv.ParseFloat(tempV, 64)
+		if err != nil {
+			envParseErrs = append(envParseErrs, fmt.Errorf("couldn't parse shutdown-power from environment: %w", err))
+		}
+	}
+	// Skip flag.Parse() under `go test`: its generated main calls
+	// testing.Init() (which registers -test.* flags) only after package
+	// inits have already run, so this init() would otherwise reject the
+	// test binary's own flags as unknown.
+	if !strings.HasSuffix(os.Args[0], ".test") {
+		flag.Parse()
+	}
+
+	level, err := parseLevel(logLevel)
+	if err != nil {
+		errLog.Warn(err)
+	}
+	dest, err := openLogDestination(logDestination)
+	if err != nil {
+		errLog.Error(err)
+		dest = os.Stderr
+	}
+	errLog = newLogger(dest, alias, level)
+
+	// envParseErrs was collected before errLog was rebuilt above, so it's
+	// reported now instead, once the operator's configured destination/level
+	// are actually in effect.
+	for _, e := range envParseErrs {
+		errLog.Error(e)
+	}
 
 	if noMetrics && dummy {
-		errLog.Println("dummy and no-metrics specified, nothing to do.")
+		errLog.Error("dummy and no-metrics specified, nothing to do.")
 		os.Exit(1)
 	}
 
-	errLog.Printf("timezone: \t%s\n", zoneName)
-	errLog.Printf("hostTag: \t%s\n", hostTag)
-	errLog.Printf("groupTag: \t%s\n", groupTag)
-	errLog.Printf("address: \t%s\n", address)
-	errLog.Printf("file: \t%s\n", conditionsPath)
-	errLog.Printf("interval: \t%s\n", interval)
+	if !noMetrics {
+		metricsSink, err = newSink(output)
+		if err != nil {
+			errLog.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	errLog.Infof("timezone: \t%s\n", zoneName)
+	errLog.Infof("hostTag: \t%s\n", hostTag)
+	errLog.Infof("groupTag: \t%s\n", groupTag)
+	errLog.Infof("address: \t%s\n", address)
+	errLog.Infof("file: \t%s\n", conditionsPath)
+	errLog.Infof("interval: \t%s\n", interval)
+	errLog.Infof("output: \t%s\n", output)
+}
+
+// shutdownSafe sets every channel to -shutdown-power when main returns
+// (after SIGINT/SIGTERM, or once the conditions file has no rows left), so
+// the light doesn't stay stuck at whatever level the last tick left it at.
+// It does nothing in -dummy mode or when no conditions file is given.
+func shutdownSafe() {
+	if dummy || conditionsPath == "" {
+		return
+	}
+	err := connManager.WithConn(func(conn *telnet.Conn) error {
+		wavelengths, err := getWl(conn)
+		if err != nil {
+			return err
+		}
+		values := make([]float64, len(wavelengths))
+		for i := range values {
+			values[i] = shutdownPower
+		}
+		return setMany(conn, values)
+	})
+	if err != nil {
+		errLog.Error(err)
+		return
+	}
+	errLog.Infof("set all channels to shutdown-power=%g\n", shutdownPower)
 }
 
 func main() {
+	startPromServer(promListen)
+
+	connManager = NewConnManager(address, time.Second*30)
+	defer connManager.Close()
+	if metricsSink != nil {
+		defer metricsSink.Close()
+	}
+
+	runCtx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		errLog.Infof("received signal %s, shutting down\n", sig)
+		cancel()
+	}()
+
 	if !noMetrics && (conditionsPath == "" || dummy) {
 
 		runMetrics := func() {
-			conn, err := telnet.DialTimeout("tcp", address, time.Second*30)
-			if err != nil {
-				errLog.Println(err)
-			}
-			defer conn.Close()
-			err = conn.SkipUntil(">")
+			var lightPower []float64
+			var lightWavelengths []string
+			err := connManager.WithConn(func(conn *telnet.Conn) (err error) {
+				lightPower, err = getPower(conn)
+				if err != nil {
+					return err
+				}
+				lightWavelengths, err = getWl(conn)
+				return err
+			})
 			if err != nil {
-				errLog.Println(err)
-				return
-			}
-
-			lightPower, err := getPower(conn)
-			if err != nil{
-				errLog.Println(err)
-				return
-			}
-			lightWavelengths, err := getWl(conn)
-			if err != nil{
-				errLog.Println(err)
+				errLog.Error(err)
+				recordPoll(nil, nil, err)
 				return
 			}
 			writeMetrics(lightWavelengths, lightPower)
+			recordPoll(lightWavelengths, lightPower, nil)
 
 			fmt.Println("wavelengths:\t\t", lightWavelengths)
 			fmt.Println("power:\t\t", lightPower)
@@ -484,16 +562,21 @@ func main() {
 		runMetrics()
 
 		ticker := time.NewTicker(interval)
-		go func() {
-			for range ticker.C {
+	metricsLoop:
+		for {
+			select {
+			case <-ticker.C:
 				runMetrics()
+			case <-runCtx.Done():
+				break metricsLoop
 			}
-		}()
-		select {}
+		}
+		ticker.Stop()
 	}
 
 	if conditionsPath != "" && !dummy {
-		runConditions()
+		runConditions(runCtx)
 	}
 
+	shutdownSafe()
 }
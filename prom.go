@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// promState holds the most recent reading and housekeeping counters served
+// by the /metrics scrape handler. It is updated from whichever of
+// runMetrics/runStuff last talked to the light successfully (or not).
+type promState struct {
+	mu sync.Mutex
+
+	wavelengths []string
+	values      []float64
+	lastPoll    time.Time
+
+	connectionErrors int
+
+	conditionsRow   int
+	conditionsTotal int
+}
+
+var promStateVal promState
+
+// recordPoll updates the cached reading used to serve /metrics. Call it
+// with a non-nil err to just bump the connection error counter.
+func recordPoll(wavelengths []string, values []float64, err error) {
+	promStateVal.mu.Lock()
+	defer promStateVal.mu.Unlock()
+
+	if err != nil {
+		promStateVal.connectionErrors++
+		return
+	}
+	promStateVal.wavelengths = wavelengths
+	promStateVal.values = values
+	promStateVal.lastPoll = time.Now()
+}
+
+// recordConditionsProgress updates the conditions-file row counters exposed
+// on /metrics.
+func recordConditionsProgress(row, total int) {
+	promStateVal.mu.Lock()
+	defer promStateVal.mu.Unlock()
+	promStateVal.conditionsRow = row
+	promStateVal.conditionsTotal = total
+}
+
+// promLabels builds the label set shared by every gauge: host/group/user/
+// alias, whichever are non-empty, plus any extra labels the caller passes.
+func promLabels(extra ...[2]string) string {
+	var pairs []string
+	add := func(k, v string) {
+		if v != "" {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", k, v))
+		}
+	}
+	add("host", hostTag)
+	add("group", groupTag)
+	add("user", userTag)
+	add("alias", alias)
+	for _, kv := range extra {
+		add(kv[0], kv[1])
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func promHandler(w http.ResponseWriter, r *http.Request) {
+	promStateVal.mu.Lock()
+	wavelengths := promStateVal.wavelengths
+	values := promStateVal.values
+	lastPoll := promStateVal.lastPoll
+	connectionErrors := promStateVal.connectionErrors
+	conditionsRow := promStateVal.conditionsRow
+	conditionsTotal := promStateVal.conditionsTotal
+	promStateVal.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	fmt.Fprintln(w, "# HELP heliospectra_rel_power Last polled or set relative power level per wavelength channel, as the light's 0-1000 level divided by -multiplier.")
+	fmt.Fprintln(w, "# TYPE heliospectra_rel_power gauge")
+	for i, wl := range wavelengths {
+		if i >= len(values) {
+			break
+		}
+		label := wl
+		if !strings.HasSuffix(label, "nm") && !strings.HasSuffix(label, "k") {
+			label += "nm"
+		}
+		fmt.Fprintf(w, "heliospectra_rel_power%s %g\n", promLabels([2]string{"wavelength", label}), values[i])
+	}
+
+	fmt.Fprintln(w, "# HELP heliospectra_connection_errors_total Number of telnet connection/read errors since start.")
+	fmt.Fprintln(w, "# TYPE heliospectra_connection_errors_total counter")
+	fmt.Fprintf(w, "heliospectra_connection_errors_total%s %d\n", promLabels(), connectionErrors)
+
+	fmt.Fprintln(w, "# HELP heliospectra_last_poll_timestamp_seconds Unix timestamp of the last successful poll.")
+	fmt.Fprintln(w, "# TYPE heliospectra_last_poll_timestamp_seconds gauge")
+	lastPollSeconds := float64(0)
+	if !lastPoll.IsZero() {
+		lastPollSeconds = float64(lastPoll.Unix())
+	}
+	fmt.Fprintf(w, "heliospectra_last_poll_timestamp_seconds%s %g\n", promLabels(), lastPollSeconds)
+
+	if conditionsTotal > 0 {
+		fmt.Fprintln(w, "# HELP heliospectra_conditions_row Row index currently being executed in the conditions file.")
+		fmt.Fprintln(w, "# TYPE heliospectra_conditions_row gauge")
+		fmt.Fprintf(w, "heliospectra_conditions_row%s %d\n", promLabels(), conditionsRow)
+
+		fmt.Fprintln(w, "# HELP heliospectra_conditions_rows_total Total number of rows in the conditions file.")
+		fmt.Fprintln(w, "# TYPE heliospectra_conditions_rows_total gauge")
+		fmt.Fprintf(w, "heliospectra_conditions_rows_total%s %d\n", promLabels(), conditionsTotal)
+	}
+}
+
+// startPromServer starts the /metrics scrape endpoint on listenAddr in the
+// background. A blank listenAddr disables it.
+func startPromServer(listenAddr string) {
+	if listenAddr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", promHandler)
+	errLog.Infof("prometheus metrics listening on %s\n", listenAddr)
+	go func() {
+		if err := http.ListenAndServe(listenAddr, mux); err != nil {
+			errLog.Error(err)
+		}
+	}()
+}
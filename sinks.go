@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdaffin/go-telegraf"
+)
+
+// MetricsSink publishes a single poll's wavelength/power reading somewhere.
+// writeMetrics hands the raw reading to whichever sink -output selected and
+// each sink builds its own measurement from it, so adding a new backend only
+// means adding a new implementation of this interface.
+type MetricsSink interface {
+	Write(wavelengths []string, lightValues []float64) error
+	Close() error
+}
+
+// newSink builds the MetricsSink selected by -output/OUTPUT.
+func newSink(output string) (MetricsSink, error) {
+	switch strings.ToLower(strings.TrimSpace(output)) {
+	case "", "telegraf":
+		return NewTelegrafUDPSink(), nil
+	case "influx":
+		return NewInfluxHTTPSink(influxURL, influxOrg, influxBucket, influxToken, influxBatchSize), nil
+	default:
+		return nil, fmt.Errorf("unknown output %q, want telegraf or influx", output)
+	}
+}
+
+// TelegrafUDPSink is the original output path: one UDP telegraf measurement
+// per poll, tagged with host/group/user/alias.
+type TelegrafUDPSink struct{}
+
+// NewTelegrafUDPSink builds a sink that writes to the telegraf UDP listener
+// named by the TELEGRAF_HOST environment variable (default telegraf:8092).
+func NewTelegrafUDPSink() *TelegrafUDPSink {
+	return &TelegrafUDPSink{}
+}
+
+func (s *TelegrafUDPSink) Write(wavelengths []string, lightValues []float64) error {
+	telegrafHost := "telegraf:8092"
+	if os.Getenv("TELEGRAF_HOST") != "" {
+		telegrafHost = os.Getenv("TELEGRAF_HOST")
+	}
+
+	telegrafClient, err := telegraf.NewUDP(telegrafHost)
+	if err != nil {
+		return err
+	}
+	defer telegrafClient.Close()
+
+	m := telegraf.NewMeasurement("helio-light")
+	if len(wavelengths) != len(lightValues) {
+		return fmt.Errorf("wavelengths and light values differ")
+	}
+
+	for i, v := range lightValues {
+		wl, err := strconv.ParseInt(wavelengths[i], 10, 64)
+		if err != nil {
+			errLog.Error(err)
+			continue
+		}
+		if wl == 6500 {
+			m.AddFloat64(fmt.Sprintf("%dk", wl), v)
+			continue
+		}
+		m.AddFloat64(fmt.Sprintf("%dnm", wl), v)
+	}
+	if hostTag != "" {
+		m.AddTag("host", hostTag)
+	}
+	if groupTag != "" {
+		m.AddTag("group", groupTag)
+	}
+	if userTag != "" {
+		m.AddTag("user", userTag)
+	}
+	if alias != "" {
+		m.AddTag("alias", alias)
+	}
+
+	return telegrafClient.Write(m)
+}
+
+func (s *TelegrafUDPSink) Close() error {
+	return nil
+}
+
+// InfluxHTTPSink serializes readings as InfluxDB line protocol and pushes
+// them straight to a v2 HTTP /api/v2/write endpoint, the way linky2influx
+// uses influxdb-client-go, for sites with no telegraf agent to hand off to.
+type InfluxHTTPSink struct {
+	writeURL string
+	token    string
+	client   *http.Client
+
+	mu        sync.Mutex
+	batch     []string
+	batchSize int
+}
+
+// NewInfluxHTTPSink builds a sink that batches lines and flushes them to
+// baseURL's /api/v2/write endpoint for org/bucket once batchSize lines have
+// accumulated. A batchSize of 1 or less writes every line immediately.
+func NewInfluxHTTPSink(baseURL, org, bucket, token string, batchSize int) *InfluxHTTPSink {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	return &InfluxHTTPSink{
+		writeURL:  strings.TrimRight(baseURL, "/") + "/api/v2/write?org=" + org + "&bucket=" + bucket + "&precision=s",
+		token:     token,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		batchSize: batchSize,
+	}
+}
+
+func (s *InfluxHTTPSink) Write(wavelengths []string, lightValues []float64) error {
+	if len(wavelengths) != len(lightValues) {
+		return fmt.Errorf("wavelengths and light values differ")
+	}
+
+	fields := make([]string, 0, len(lightValues))
+	for i, v := range lightValues {
+		wl, err := strconv.ParseInt(wavelengths[i], 10, 64)
+		if err != nil {
+			errLog.Error(err)
+			continue
+		}
+		field := fmt.Sprintf("%dnm", wl)
+		if wl == 6500 {
+			field = fmt.Sprintf("%dk", wl)
+		}
+		fields = append(fields, fmt.Sprintf("%s=%s", field, strconv.FormatFloat(v, 'f', -1, 64)))
+	}
+	if len(fields) == 0 {
+		return fmt.Errorf("no valid fields to write")
+	}
+
+	tags := ""
+	for _, t := range []struct{ k, v string }{{"host", hostTag}, {"group", groupTag}, {"user", userTag}, {"alias", alias}} {
+		if t.v != "" {
+			tags += fmt.Sprintf(",%s=%s", t.k, lineProtocolEscape(t.v))
+		}
+	}
+
+	line := fmt.Sprintf("helio-light%s %s %d", tags, strings.Join(fields, ","), time.Now().Unix())
+
+	s.mu.Lock()
+	s.batch = append(s.batch, line)
+	flush := len(s.batch) >= s.batchSize
+	var toSend []string
+	if flush {
+		toSend = s.batch
+		s.batch = nil
+	}
+	s.mu.Unlock()
+
+	if !flush {
+		return nil
+	}
+	return s.writeLines(toSend)
+}
+
+// lineProtocolEscape escapes the characters line protocol treats specially
+// in tag keys/values (space, comma, equals).
+func lineProtocolEscape(s string) string {
+	replacer := strings.NewReplacer(" ", "\\ ", ",", "\\,", "=", "\\=")
+	return replacer.Replace(s)
+}
+
+// Flush sends any batched-but-unsent lines immediately.
+func (s *InfluxHTTPSink) Flush() error {
+	s.mu.Lock()
+	toSend := s.batch
+	s.batch = nil
+	s.mu.Unlock()
+	if len(toSend) == 0 {
+		return nil
+	}
+	return s.writeLines(toSend)
+}
+
+// writeLines gzips and POSTs lines to the write endpoint, retrying a
+// handful of times on 5xx responses.
+func (s *InfluxHTTPSink) writeLines(lines []string) error {
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	if _, err := gz.Write([]byte(strings.Join(lines, "\n"))); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	payload := body.Bytes()
+
+	var lastErr error
+	for attempt := 0; attempt < 5; attempt++ {
+		req, err := http.NewRequest(http.MethodPost, s.writeURL, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		req.Header.Set("Content-Encoding", "gzip")
+		req.Header.Set("Authorization", "Token "+s.token)
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			lastErr = err
+			time.Sleep(time.Duration(attempt+1) * 200 * time.Millisecond)
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= 500 {
+			lastErr = fmt.Errorf("influx write: server error %s", resp.Status)
+			time.Sleep(time.Duration(attempt+1) * 200 * time.Millisecond)
+			continue
+		}
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("influx write: %s", resp.Status)
+		}
+		return nil
+	}
+	return lastErr
+}
+
+func (s *InfluxHTTPSink) Close() error {
+	return s.Flush()
+}